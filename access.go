@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ipFilter implements CIDR-based allow/deny lists. A blacklist match always
+// wins; if a whitelist is configured, only addresses matching it are let
+// through.
+type ipFilter struct {
+	whitelist []*net.IPNet
+	blacklist []*net.IPNet
+}
+
+func newIPFilter(whiteCIDRs, blackCIDRs []string) *ipFilter {
+	return &ipFilter{
+		whitelist: parseCIDRList(whiteCIDRs),
+		blacklist: parseCIDRList(blackCIDRs),
+	}
+}
+
+func parseCIDRList(cidrs []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			logger.Warnf("Skipping invalid CIDR %q: %v", c, err)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func matchesAny(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed reports whether ip passes the filter: blacklisted addresses are
+// always rejected; if a whitelist is configured, only whitelisted addresses
+// pass; otherwise everything not blacklisted passes.
+func (f *ipFilter) Allowed(ip net.IP) bool {
+	if ip == nil {
+		return len(f.whitelist) == 0
+	}
+	if matchesAny(ip, f.blacklist) {
+		return false
+	}
+	if len(f.whitelist) > 0 {
+		return matchesAny(ip, f.whitelist)
+	}
+	return true
+}
+
+// keyAllowList is a reloadable set of API keys permitted by filtermustkey,
+// backed by a plain newline-delimited file so operators can update it
+// without restarting the process.
+type keyAllowList struct {
+	mu   sync.RWMutex
+	path string
+	set  map[string]struct{}
+}
+
+func newKeyAllowList(path string) *keyAllowList {
+	k := &keyAllowList{path: path}
+	if path != "" {
+		if err := k.Reload(); err != nil {
+			logger.Warnf("Failed to load key allow-list %q: %v", path, err)
+		}
+	}
+	return k
+}
+
+// Reload re-reads the backing file, replacing the in-memory set.
+func (k *keyAllowList) Reload() error {
+	if k.path == "" {
+		return nil
+	}
+	f, err := os.Open(k.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	set := make(map[string]struct{})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		set[line] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	k.set = set
+	k.mu.Unlock()
+	return nil
+}
+
+// Allowed reports whether key is present in the list. With no backing file
+// configured, every non-empty key is allowed (the check degrades to
+// presence-only, i.e. filtermustkey without an allow-list).
+func (k *keyAllowList) Allowed(key string) bool {
+	if k.path == "" {
+		return key != ""
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	_, ok := k.set[key]
+	return ok
+}
+
+// clientIP extracts the address access control should evaluate, per
+// config.IPFilterMode: "xff" trusts the last hop of X-Forwarded-For (for
+// deployments behind a trusted reverse proxy), "remote" (default) uses
+// r.RemoteAddr directly.
+func clientIP(r *http.Request) net.IP {
+	if strings.EqualFold(config.IPFilterMode, "xff") {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			parts := strings.Split(xff, ",")
+			last := strings.TrimSpace(parts[len(parts)-1])
+			if ip := net.ParseIP(last); ip != nil {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// checkBasicOrBearerAuth reports whether the request carries valid
+// credentials, either HTTP Basic auth against config.AuthUser/AuthPasswd or
+// a bearer token present in config.AuthTokens. Auth is skipped entirely
+// (request passes) when neither is configured.
+func checkBasicOrBearerAuth(r *http.Request) bool {
+	noBasic := config.AuthUser == "" && config.AuthPasswd == ""
+	noTokens := len(config.AuthTokens) == 0
+	if noBasic && noTokens {
+		return true
+	}
+
+	if !noBasic {
+		if user, pass, ok := r.BasicAuth(); ok {
+			userOK := subtle.ConstantTimeCompare([]byte(user), []byte(config.AuthUser)) == 1
+			passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(config.AuthPasswd)) == 1
+			if userOK && passOK {
+				return true
+			}
+		}
+	}
+
+	if !noTokens {
+		authz := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(authz, "Bearer ")
+		if token != authz { // had the prefix
+			for _, t := range config.AuthTokens {
+				if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// accessMiddleware enforces IP allow/deny lists, optional auth, and the
+// filtermustkey requirement before a request reaches logMiddleware/proxy.
+func accessMiddleware(filter *ipFilter, keys *keyAllowList, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := clientIP(r); !filter.Allowed(ip) {
+			logger.Warnf("Blocked by IP filter: %s", r.RemoteAddr)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if !checkBasicOrBearerAuth(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="restricted"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if config.RequireAPIKey {
+			match := keyRegex.FindStringSubmatch(r.URL.RawQuery)
+			if match == nil || !keys.Allowed(match[2]) {
+				http.Error(w, "Forbidden: missing or invalid API key", http.StatusForbidden)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// subnetCandidate is one locally-configured IPv6 prefix we could source
+// connections from, along with the address-state flags RFC 6724 source
+// selection cares about.
+type subnetCandidate struct {
+	network    *net.IPNet
+	deprecated bool
+	temporary  bool
+}
+
+// initLocalSubnets populates localSubnets, either from a manual override
+// (-cidr, comma-separated) or by auto-detecting every non-link-local IPv6
+// prefix configured on the host.
+func initLocalSubnets() error {
+	if config.ManualCIDR != "" {
+		var candidates []subnetCandidate
+		for _, cidr := range splitCSV(config.ManualCIDR) {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("invalid CIDR %q: %v", cidr, err)
+			}
+			candidates = append(candidates, subnetCandidate{network: network})
+		}
+		localSubnets = candidates
+		logger.Infof("Using %d manually-configured subnet(s)", len(localSubnets))
+		return nil
+	}
+
+	candidates, err := detectLocalSubnets()
+	if err != nil || len(candidates) == 0 {
+		return fmt.Errorf("no subnet detected, use -cidr: %v", err)
+	}
+	localSubnets = candidates
+	logger.Infof("Auto-detected %d subnet(s)", len(localSubnets))
+	return nil
+}
+
+// detectLocalSubnets runs `ip -6 addr show` and parses every non-link-local
+// "inet6" line into a subnetCandidate, picking up the "deprecated" and
+// "temporary" address-state flags the kernel reports alongside each prefix.
+func detectLocalSubnets() ([]subnetCandidate, error) {
+	out, err := exec.Command("sh", "-c", "ip -6 addr show").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []subnetCandidate
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "inet6" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(fields[1])
+		if err != nil || network.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		c := subnetCandidate{network: network}
+		for _, f := range fields[2:] {
+			switch f {
+			case "deprecated":
+				c.deprecated = true
+			case "temporary":
+				c.temporary = true
+			}
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, scanner.Err()
+}
+
+// ipv6Label is a simplified RFC 6724 policy-table label: addresses that
+// "look the same kind" as each other get the same label, so Rule 6 (prefer
+// matching label) steers us away from e.g. picking a 6to4 source for a
+// native destination.
+func ipv6Label(ip net.IP) int {
+	switch {
+	case ip.Equal(net.IPv6loopback):
+		return 0
+	case ip.To4() != nil:
+		return 4 // IPv4-mapped
+	case isULA(ip):
+		return 13 // fc00::/7
+	case is6to4(ip):
+		return 2 // 2002::/16
+	case isTeredo(ip):
+		return 5 // 2001::/32
+	default:
+		return 1 // default global unicast
+	}
+}
+
+func isULA(ip net.IP) bool {
+	return len(ip) >= 1 && ip[0]&0xfe == 0xfc
+}
+
+func is6to4(ip net.IP) bool {
+	return len(ip) >= 2 && ip[0] == 0x20 && ip[1] == 0x02
+}
+
+func isTeredo(ip net.IP) bool {
+	return len(ip) >= 4 && ip[0] == 0x20 && ip[1] == 0x01 && ip[2] == 0x00 && ip[3] == 0x00
+}
+
+// commonPrefixBits returns the number of leading bits shared by a and b.
+func commonPrefixBits(a, b net.IP) int {
+	a16, b16 := a.To16(), b.To16()
+	if a16 == nil || b16 == nil {
+		return 0
+	}
+	bits := 0
+	for i := 0; i < 16; i++ {
+		x := a16[i] ^ b16[i]
+		if x == 0 {
+			bits += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			bits++
+			x <<= 1
+		}
+		break
+	}
+	return bits
+}
+
+// selectSourceSubnet picks the best candidate to source a connection to
+// dest from, per a simplified RFC 6724: prefer non-deprecated/non-temporary
+// addresses, prefer a matching label, then prefer the longest common prefix
+// with the destination. Returns nil if no candidates are configured.
+func selectSourceSubnet(dest net.IP) *net.IPNet {
+	if len(localSubnets) == 0 {
+		return nil
+	}
+
+	destLabel := ipv6Label(dest)
+	var best *subnetCandidate
+	var bestScore [3]int // [stable(1/0), labelMatch(1/0), commonPrefixBits]
+
+	for i := range localSubnets {
+		c := &localSubnets[i]
+		stable := 1
+		if c.deprecated || c.temporary {
+			stable = 0
+		}
+		labelMatch := 0
+		if ipv6Label(c.network.IP) == destLabel {
+			labelMatch = 1
+		}
+		score := [3]int{stable, labelMatch, commonPrefixBits(c.network.IP, dest)}
+
+		if best == nil || score[0] > bestScore[0] ||
+			(score[0] == bestScore[0] && score[1] > bestScore[1]) ||
+			(score[0] == bestScore[0] && score[1] == bestScore[1] && score[2] > bestScore[2]) {
+			best = c
+			bestScore = score
+		}
+	}
+	return best.network
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"crypto/rand"
 	"crypto/tls"
@@ -9,13 +8,11 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"math/big"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -38,9 +35,8 @@ const (
 var (
 	config      Config
 	logger      *LeveledLogger
-	localSubnet *net.IPNet
-	validIPv6s  []string
-	mu          sync.RWMutex // Protects validIPv6s
+	localSubnets []subnetCandidate
+	pool        = newIPPool() // Destination IPv6s with per-address health tracking
 	keyRegex    = regexp.MustCompile(`(?i)(key|api_key)=([^&]+)`)
 )
 
@@ -53,6 +49,32 @@ type Config struct {
 	ManualCIDR     string
 	LogLevel       string
 	LogFile        string
+
+	// Happy-Eyeballs style concurrent dialing
+	DialParallelism int           // number of candidate IPs to race concurrently
+	DialStagger     time.Duration // delay between launching successive candidates
+	DialTimeout     time.Duration // per-attempt dial timeout
+
+	// Client-side access control
+	AuthUser         string        // HTTP Basic auth username, if set
+	AuthPasswd       string        // HTTP Basic auth password, if set
+	AuthTokens       []string      // accepted bearer tokens, if set
+	WhiteIPs         []string      // CIDR allow-list; if non-empty, only these pass
+	BlackIPs         []string      // CIDR deny-list; always rejected
+	IPFilterMode     string        // "remote" (default) or "xff"
+	RequireAPIKey    bool          // filtermustkey: reject requests without a recognized key= / api_key=
+	KeyAllowListFile string        // optional file of allowed keys, reloaded periodically
+	AccessReload     time.Duration // how often KeyAllowListFile is re-read
+
+	// DNS-based IP discovery (alternative/addition to IPv6ListURL)
+	EnableDNSSource bool          // also resolve TargetHost/AliasHosts via DNS
+	AliasHosts      []string      // extra hostnames to resolve alongside TargetHost
+	DNSServers      []string      // "host:port" classic resolvers or "https://..." DoH endpoints
+	DNSCacheTTL     time.Duration // how long a resolved AAAA answer is cached
+
+	// Metrics
+	MetricsPath       string // path for the Prometheus exporter on the main listener
+	MetricsListenAddr string // if set, serve /metrics on a separate admin listener instead
 }
 
 // LeveledLogger provides basic leveled logging
@@ -66,7 +88,7 @@ func main() {
 	setupLogger()
 
 	// 1. Network Initialization
-	if err := initLocalSubnet(); err != nil {
+	if err := initLocalSubnets(); err != nil {
 		logger.Fatalf("Failed to init local subnet: %v", err)
 	}
 
@@ -99,10 +121,35 @@ func main() {
 		},
 	}
 
-	// 4. Start Server
+	// 4. Access control setup
+	filter := newIPFilter(config.WhiteIPs, config.BlackIPs)
+	keys := newKeyAllowList(config.KeyAllowListFile)
+	if config.KeyAllowListFile != "" {
+		go keyAllowListReloadLoop(keys)
+	}
+
+	// 5. Metrics setup
+	if config.MetricsListenAddr != "" {
+		adminMux := http.NewServeMux()
+		adminMux.HandleFunc("/metrics", metricsHandler)
+		go func() {
+			if err := http.ListenAndServe(config.MetricsListenAddr, adminMux); err != nil {
+				logger.Errorf("Admin metrics server failed: %v", err)
+			}
+		}()
+	}
+
+	// 6. Start Server
+	mux := http.NewServeMux()
+	mux.Handle("/debug/pool", accessMiddleware(filter, keys, http.HandlerFunc(debugPoolHandler(pool))))
+	if config.MetricsListenAddr == "" {
+		mux.Handle(config.MetricsPath, accessMiddleware(filter, keys, http.HandlerFunc(metricsHandler)))
+	}
+	mux.Handle("/", accessMiddleware(filter, keys, logMiddleware(proxy)))
+
 	server := &http.Server{
 		Addr:    config.ListenAddr,
-		Handler: logMiddleware(proxy),
+		Handler: mux,
 	}
 
 	fmt.Printf("%s started on %s (Level: %s)\n", AppName, config.ListenAddr, config.LogLevel)
@@ -139,38 +186,136 @@ func newTransport() *http.Transport {
 
 // dialCustom handles the core IPv6 rotation logic (Src & Dest)
 func dialCustom(ctx context.Context) (net.Conn, error) {
-	dialer := &net.Dialer{
-		Timeout:   10 * time.Second,
-		KeepAlive: 30 * time.Second,
+	// Pick a bounded set of candidate destination IPv6s, without replacement
+	candidates := pickRandomDestIPs(config.DialParallelism)
+	if len(candidates) == 0 {
+		// Fallback to DNS resolution if list is empty. Resolve TargetHost
+		// ourselves (it's a hostname, not an IP) so selectSourceSubnet has a
+		// real destination address to pick a source prefix against, and
+		// dial that address directly to keep the two in sync.
+		dialer := &net.Dialer{Timeout: config.DialTimeout, KeepAlive: 30 * time.Second}
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip6", config.TargetHost)
+		if err != nil {
+			return nil, fmt.Errorf("dns fallback: resolve %s: %w", config.TargetHost, err)
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("dns fallback: no AAAA records for %s", config.TargetHost)
+		}
+		dest := ips[0]
+		if subnet := selectSourceSubnet(dest); subnet != nil {
+			if srcIP := genRandomIPv6(subnet); srcIP != nil {
+				dialer.LocalAddr = &net.TCPAddr{IP: srcIP}
+			}
+		}
+		return dialer.DialContext(ctx, "tcp6", net.JoinHostPort(dest.String(), "443"))
 	}
 
-	// Bind random source IPv6
-	if srcIP := genRandomIPv6(localSubnet); srcIP != nil {
-		dialer.LocalAddr = &net.TCPAddr{IP: srcIP}
+	return dialHappyEyeballs(ctx, candidates)
+}
+
+// dialHappyEyeballs races concurrent dials against candidates, staggered by
+// config.DialStagger, and returns the first successful connection. Losers
+// (including late winners after the context is already satisfied) are
+// closed so we never leak sockets.
+func dialHappyEyeballs(ctx context.Context, candidates []string) (net.Conn, error) {
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+		ip   string
 	}
+	results := make(chan dialResult, len(candidates))
+
+	var wg sync.WaitGroup
+	for i, destIP := range candidates {
+		wg.Add(1)
+		go func(i int, destIP string) {
+			defer wg.Done()
+
+			if i > 0 {
+				select {
+				case <-time.After(time.Duration(i) * config.DialStagger):
+				case <-raceCtx.Done():
+					results <- dialResult{err: raceCtx.Err(), ip: destIP}
+					return
+				}
+			}
+			if raceCtx.Err() != nil {
+				results <- dialResult{err: raceCtx.Err(), ip: destIP}
+				return
+			}
+
+			dialer := &net.Dialer{
+				Timeout:   config.DialTimeout,
+				KeepAlive: 30 * time.Second,
+			}
+			var prefix string
+			if subnet := selectSourceSubnet(net.ParseIP(destIP)); subnet != nil {
+				prefix = subnet.String()
+				if srcIP := genRandomIPv6(subnet); srcIP != nil {
+					dialer.LocalAddr = &net.TCPAddr{IP: srcIP}
+				}
+			}
+
+			if logger.level <= LevelDebug {
+				src := "System"
+				if dialer.LocalAddr != nil {
+					src = dialer.LocalAddr.String()
+				}
+				logger.Debugf("Dial attempt %d: %s -> %s", i, src, destIP)
+			}
 
-	// Pick random destination IPv6
-	destIP := pickRandomDestIP()
-	if destIP == "" {
-		// Fallback to DNS resolution if list is empty
-		return dialer.DialContext(ctx, "tcp6", net.JoinHostPort(config.TargetHost, "443"))
+			attemptStart := time.Now()
+			conn, err := dialer.DialContext(raceCtx, "tcp6", net.JoinHostPort(destIP, "443"))
+			latency := time.Since(attemptStart)
+			if err != nil {
+				pool.MarkFail(destIP, err)
+			} else {
+				pool.MarkOK(destIP, latency)
+			}
+			metrics.ObserveDial(prefix, destIP, err == nil, latency)
+			results <- dialResult{conn: conn, err: err, ip: destIP}
+		}(i, destIP)
 	}
 
-	if logger.level <= LevelDebug {
-		src := "System"
-		if dialer.LocalAddr != nil {
-			src = dialer.LocalAddr.String()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var firstErr error
+	for res := range results {
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if res.conn != nil {
+				res.conn.Close()
+			}
+			continue
 		}
-		logger.Debugf("Dial: %s -> %s", src, destIP)
+		if res.conn == nil {
+			continue
+		}
+		// We have a winner; cancel the rest and drain/close any late arrivals.
+		cancel()
+		go func() {
+			for late := range results {
+				if late.conn != nil {
+					late.conn.Close()
+				}
+			}
+		}()
+		return res.conn, nil
 	}
 
-	// Force IPv6 connection via IP to bypass DNS
-	conn, err := dialer.DialContext(ctx, "tcp6", net.JoinHostPort(destIP, "443"))
-	if err != nil {
-		logger.Warnf("Dial failed to %s: %v", destIP, err)
-		return nil, err
+	if firstErr == nil {
+		firstErr = fmt.Errorf("all %d dial candidates failed", len(candidates))
 	}
-	return conn, nil
+	logger.Warnf("Happy-eyeballs dial failed across %d candidates: %v", len(candidates), firstErr)
+	return nil, firstErr
 }
 
 // ipUpdaterLoop runs in background to refresh valid IPs
@@ -187,44 +332,74 @@ func ipUpdaterLoop() {
 	}
 }
 
-func fetchAndReloadIPs() error {
-	client := &http.Client{Timeout: 15 * time.Second}
-	resp, err := client.Get(config.IPv6ListURL)
-	if err != nil {
-		return err
+// keyAllowListReloadLoop periodically re-reads the API key allow-list file
+// so it can be updated without restarting the process.
+func keyAllowListReloadLoop(keys *keyAllowList) {
+	ticker := time.NewTicker(config.AccessReload)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := keys.Reload(); err != nil {
+			logger.Warnf("Key allow-list reload failed: %v", err)
+		}
+	}
+}
+
+// ipSources holds the composed set of discovery mechanisms; built lazily on
+// first use once config is fully parsed.
+var ipSources []ipSource
+
+func buildIPSources() []ipSource {
+	var sources []ipSource
+	if config.IPv6ListURL != "" {
+		sources = append(sources, newHTTPListSource(config.IPv6ListURL))
+	}
+	if config.EnableDNSSource {
+		hosts := append([]string{config.TargetHost}, config.AliasHosts...)
+		sources = append(sources, newDNSSource(hosts, config.DNSServers, config.DNSCacheTTL))
 	}
-	defer resp.Body.Close()
+	return sources
+}
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("http status: %d", resp.StatusCode)
+// fetchAndReloadIPs pulls fresh candidates from every configured ipSource,
+// unions them, and merges the result into the pool (preserving health state
+// for addresses that are still present).
+func fetchAndReloadIPs() error {
+	if ipSources == nil {
+		ipSources = buildIPSources()
 	}
 
-	var tempIPs []string
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
+	seen := make(map[string]struct{})
+	var merged []string
+	var firstErr error
+
+	for _, src := range ipSources {
+		ips, err := src.Fetch(context.Background())
+		recordSourceResult(src.Name(), err)
+		if err != nil {
+			logger.Warnf("Source %s fetch failed: %v", src.Name(), err)
+			if firstErr == nil {
+				firstErr = err
+			}
 			continue
 		}
-		// Validate IPv6
-		if ip := net.ParseIP(line); ip != nil && ip.To4() == nil {
-			tempIPs = append(tempIPs, line)
+		for _, ip := range ips {
+			if _, ok := seen[ip]; !ok {
+				seen[ip] = struct{}{}
+				merged = append(merged, ip)
+			}
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("read error: %v", err)
-	}
-	if len(tempIPs) == 0 {
+	if len(merged) == 0 {
+		if firstErr != nil {
+			return firstErr
+		}
 		return fmt.Errorf("empty valid IP list")
 	}
 
-	mu.Lock()
-	validIPv6s = tempIPs
-	count := len(validIPv6s)
-	mu.Unlock()
-
-	logger.Infof("Loaded %d IPv6 addresses", count)
+	pool.Merge(merged)
+	logger.Infof("Loaded %d IPv6 addresses from %d source(s)", pool.Len(), len(ipSources))
 	return nil
 }
 
@@ -251,64 +426,30 @@ func genRandomIPv6(network *net.IPNet) net.IP {
 	return finalIP
 }
 
-func pickRandomDestIP() string {
-	mu.RLock()
-	defer mu.RUnlock()
-	if len(validIPv6s) == 0 {
-		return ""
-	}
-	n, err := rand.Int(rand.Reader, big.NewInt(int64(len(validIPv6s))))
-	if err != nil {
-		return validIPv6s[0]
-	}
-	return validIPv6s[n.Int64()]
+// pickRandomDestIPs draws up to n distinct, healthy addresses from the pool
+// without replacement, in randomized order, for use as Happy-Eyeballs
+// candidates. Addresses with a poor recent success ratio are skipped until
+// their cooldown expires.
+func pickRandomDestIPs(n int) []string {
+	return pool.Candidates(n)
 }
 
-func initLocalSubnet() error {
-	cidr := config.ManualCIDR
-	
-	// Auto-detect if not provided
-	if cidr == "" {
-		cmd := exec.Command("sh", "-c", "ip -6 route show table local | grep -v '^fe80' | grep '/' | head -n 1")
-		out, _ := cmd.Output()
-		fields := strings.Fields(string(out))
-		for _, f := range fields {
-			if strings.Contains(f, "/") {
-				cidr = f
-				break
-			}
-		}
-		if cidr != "" {
-			logger.Infof("Auto-detected subnet: %s", cidr)
-		}
-	}
-
-	if cidr == "" {
-		return fmt.Errorf("no subnet detected, use -cidr")
-	}
-
-	_, network, err := net.ParseCIDR(cidr)
-	if err != nil {
-		return fmt.Errorf("invalid CIDR: %v", err)
-	}
-	localSubnet = network
-	return nil
-}
-
-// logMiddleware logs requests and redacts sensitive keys
+// logMiddleware logs requests, redacts sensitive keys, and feeds the
+// Prometheus-style request/byte counters.
 func logMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if logger.level > LevelInfo {
-			next.ServeHTTP(w, r)
-			return
-		}
-		
 		start := time.Now()
 		ww := &responseWrapper{ResponseWriter: w, statusCode: 200}
 		next.ServeHTTP(ww, r)
-		
+		duration := time.Since(start)
+
+		metrics.ObserveRequest(ww.statusCode, duration, r.ContentLength, ww.bytesWritten)
+
+		if logger.level > LevelInfo {
+			return
+		}
 		safeURL := keyRegex.ReplaceAllString(r.URL.String(), "$1=[REDACTED]")
-		logger.Infof("[%d] %s %s | %s | %v", ww.statusCode, r.Method, safeURL, r.RemoteAddr, time.Since(start))
+		logger.Infof("[%d] %s %s | %s | %v", ww.statusCode, r.Method, safeURL, r.RemoteAddr, duration)
 	})
 }
 
@@ -321,6 +462,17 @@ func parseConfig() {
 		IPv6ListURL:    "https://raw.githubusercontent.com/ccbkkb/ipv6-googleapis/refs/heads/main/valid_ips.txt",
 		UpdateInterval: 1 * time.Hour,
 		LogLevel:       "ERROR",
+
+		DialParallelism: 3,
+		DialStagger:     250 * time.Millisecond,
+		DialTimeout:     10 * time.Second,
+
+		IPFilterMode: "remote",
+		AccessReload: 1 * time.Minute,
+
+		DNSCacheTTL: 5 * time.Minute,
+
+		MetricsPath: "/metrics",
 	}
 
 	// Environment overrides
@@ -329,13 +481,73 @@ func parseConfig() {
 	if v := os.Getenv("IPV6_CIDR"); v != "" { config.ManualCIDR = v }
 	if v := os.Getenv("LOG_LEVEL"); v != "" { config.LogLevel = v }
 	if v := os.Getenv("LOG_FILE"); v != "" { config.LogFile = v }
+	if v := os.Getenv("AUTH_USER"); v != "" { config.AuthUser = v }
+	if v := os.Getenv("AUTH_PASSWD"); v != "" { config.AuthPasswd = v }
+	if v := os.Getenv("AUTH_TOKENS"); v != "" { config.AuthTokens = splitCSV(v) }
+	if v := os.Getenv("WHITE_IPS"); v != "" { config.WhiteIPs = splitCSV(v) }
+	if v := os.Getenv("BLACK_IPS"); v != "" { config.BlackIPs = splitCSV(v) }
+	if v := os.Getenv("IP_FILTER_MODE"); v != "" { config.IPFilterMode = v }
+	if v := os.Getenv("FILTER_MUST_KEY"); v != "" { config.RequireAPIKey = v == "1" || strings.EqualFold(v, "true") }
+	if v := os.Getenv("KEY_ALLOW_LIST_FILE"); v != "" { config.KeyAllowListFile = v }
+	if v := os.Getenv("DNS_SOURCE_ENABLE"); v != "" { config.EnableDNSSource = v == "1" || strings.EqualFold(v, "true") }
+	if v := os.Getenv("DNS_ALIAS_HOSTS"); v != "" { config.AliasHosts = splitCSV(v) }
+	if v := os.Getenv("DNS_SERVERS"); v != "" { config.DNSServers = splitCSV(v) }
+	if v := os.Getenv("METRICS_PATH"); v != "" { config.MetricsPath = v }
+	if v := os.Getenv("METRICS_LISTEN_ADDR"); v != "" { config.MetricsListenAddr = v }
 
 	// Flags overrides
+	var whiteIPs, blackIPs, authTokens string
 	flag.StringVar(&config.ListenAddr, "listen", config.ListenAddr, "Address to listen on")
-	flag.StringVar(&config.ManualCIDR, "cidr", config.ManualCIDR, "Manual IPv6 CIDR (e.g. 2001:db8::/48)")
+	flag.StringVar(&config.ManualCIDR, "cidr", config.ManualCIDR, "Manual IPv6 CIDR(s), comma-separated, overriding auto-detection (e.g. 2001:db8::/48,fd00::/8)")
 	flag.StringVar(&config.LogLevel, "log-level", config.LogLevel, "Log level: DEBUG, INFO, WARN, ERROR")
 	flag.StringVar(&config.LogFile, "log-file", config.LogFile, "Path to log file")
+	flag.IntVar(&config.DialParallelism, "dial-parallelism", config.DialParallelism, "Number of candidate IPs to dial concurrently (Happy Eyeballs)")
+	flag.DurationVar(&config.DialStagger, "dial-stagger", config.DialStagger, "Delay between launching successive concurrent dial attempts")
+	flag.DurationVar(&config.DialTimeout, "dial-timeout", config.DialTimeout, "Timeout for a single dial attempt")
+	flag.StringVar(&config.AuthUser, "authuser", config.AuthUser, "HTTP Basic auth username (optional)")
+	flag.StringVar(&config.AuthPasswd, "authpasswd", config.AuthPasswd, "HTTP Basic auth password (optional)")
+	flag.StringVar(&authTokens, "authtokens", "", "Comma-separated bearer tokens accepted in Authorization headers")
+	flag.StringVar(&whiteIPs, "whiteip", "", "Comma-separated CIDR allow-list; if set, only matching clients pass")
+	flag.StringVar(&blackIPs, "blackip", "", "Comma-separated CIDR deny-list; matching clients are always rejected")
+	flag.StringVar(&config.IPFilterMode, "ipfiltermode", config.IPFilterMode, "Address used for IP filtering: remote or xff")
+	flag.BoolVar(&config.RequireAPIKey, "filtermustkey", config.RequireAPIKey, "Reject requests missing a key=/api_key= parameter")
+	flag.StringVar(&config.KeyAllowListFile, "keyallowlist", config.KeyAllowListFile, "Path to a reloadable file of allowed API keys")
+	flag.DurationVar(&config.AccessReload, "access-reload", config.AccessReload, "How often the key allow-list file is re-read")
+	var aliasHosts, dnsServers string
+	flag.BoolVar(&config.EnableDNSSource, "dns-source", config.EnableDNSSource, "Also discover destination IPs by resolving TargetHost/alias hosts via DNS")
+	flag.StringVar(&aliasHosts, "dns-alias-hosts", "", "Comma-separated extra hostnames to resolve alongside TargetHost")
+	flag.StringVar(&dnsServers, "dns-servers", "", "Comma-separated DNS servers: host:port, or https://... for DoH")
+	flag.DurationVar(&config.DNSCacheTTL, "dns-cache-ttl", config.DNSCacheTTL, "How long a resolved AAAA answer is cached")
+	flag.StringVar(&config.MetricsPath, "metrics-path", config.MetricsPath, "Path for the Prometheus metrics endpoint on the main listener")
+	flag.StringVar(&config.MetricsListenAddr, "metrics-listen", config.MetricsListenAddr, "If set, serve /metrics on a separate admin address instead of the main listener")
 	flag.Parse()
+
+	if authTokens != "" {
+		config.AuthTokens = splitCSV(authTokens)
+	}
+	if whiteIPs != "" {
+		config.WhiteIPs = splitCSV(whiteIPs)
+	}
+	if blackIPs != "" {
+		config.BlackIPs = splitCSV(blackIPs)
+	}
+	if aliasHosts != "" {
+		config.AliasHosts = splitCSV(aliasHosts)
+	}
+	if dnsServers != "" {
+		config.DNSServers = splitCSV(dnsServers)
+	}
+}
+
+// splitCSV splits a comma-separated string into trimmed, non-empty entries.
+func splitCSV(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
 }
 
 // Helper: Logger Setup
@@ -372,7 +584,13 @@ func (l *LeveledLogger) Fatalf(f string, v ...interface{}) { l.logger.Printf("[F
 // Helper: Response Wrapper
 type responseWrapper struct {
 	http.ResponseWriter
-	statusCode int
+	statusCode   int
+	bytesWritten int64
 }
 func (rw *responseWrapper) WriteHeader(code int) { rw.statusCode = code; rw.ResponseWriter.WriteHeader(code) }
+func (rw *responseWrapper) Write(b []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytesWritten += int64(n)
+	return n, err
+}
 func (rw *responseWrapper) Flush() { if f, ok := rw.ResponseWriter.(http.Flusher); ok { f.Flush() } }
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// counterVec is a minimal labeled counter: a map of label-value string to
+// count, guarded by a mutex. Good enough for this binary's cardinality
+// (status classes, a handful of source prefixes, per-destination IPs).
+type counterVec struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func newCounterVec() *counterVec {
+	return &counterVec{counts: make(map[string]uint64)}
+}
+
+func (c *counterVec) Inc(label string) {
+	c.mu.Lock()
+	c.counts[label]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) snapshot() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]uint64, len(c.counts))
+	for k, v := range c.counts {
+		out[k] = v
+	}
+	return out
+}
+
+// histogram is a minimal cumulative-bucket histogram, in the style of the
+// Prometheus exposition format: counts[i] is the number of observations
+// <= buckets[i].
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sum += v
+	h.count++
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+}
+
+func (h *histogram) snapshot() (buckets []float64, counts []uint64, sum float64, count uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	buckets = append([]float64(nil), h.buckets...)
+	counts = append([]uint64(nil), h.counts...)
+	return buckets, counts, h.sum, h.count
+}
+
+var requestDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+var dialLatencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2, 5}
+
+// metricsRegistry is a small, dependency-free set of Prometheus-style
+// counters and histograms covering request handling, upstream dials, and
+// IP-list refreshes.
+type metricsRegistry struct {
+	requestsByClass *counterVec
+	requestDuration *histogram
+	bytesIn         uint64 // atomic
+	bytesOut        uint64 // atomic
+
+	dialByPrefix *counterVec // label: "<prefix>|<result>"
+	dialByDest   *counterVec // label: "<dest>|<result>"
+	dialLatency  *histogram
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		requestsByClass: newCounterVec(),
+		requestDuration: newHistogram(requestDurationBuckets),
+		dialByPrefix:    newCounterVec(),
+		dialByDest:      newCounterVec(),
+		dialLatency:     newHistogram(dialLatencyBuckets),
+	}
+}
+
+var metrics = newMetricsRegistry()
+
+// ObserveRequest records one proxied HTTP request/response cycle.
+func (m *metricsRegistry) ObserveRequest(statusCode int, duration time.Duration, bytesIn, bytesOut int64) {
+	m.requestsByClass.Inc(statusClass(statusCode))
+	m.requestDuration.Observe(duration.Seconds())
+	if bytesIn > 0 {
+		atomic.AddUint64(&m.bytesIn, uint64(bytesIn))
+	}
+	if bytesOut > 0 {
+		atomic.AddUint64(&m.bytesOut, uint64(bytesOut))
+	}
+}
+
+// ObserveDial records the outcome of one dial attempt against destIP, sourced
+// from the given local prefix (may be empty if no source subnet was picked).
+func (m *metricsRegistry) ObserveDial(prefix, destIP string, ok bool, latency time.Duration) {
+	result := "fail"
+	if ok {
+		result = "success"
+	}
+	if prefix != "" {
+		m.dialByPrefix.Inc(prefix + "|" + result)
+	}
+	m.dialByDest.Inc(destIP + "|" + result)
+	m.dialLatency.Observe(latency.Seconds())
+}
+
+func statusClass(code int) string {
+	switch {
+	case code >= 200 && code < 300:
+		return "2xx"
+	case code >= 300 && code < 400:
+		return "3xx"
+	case code >= 400 && code < 500:
+		return "4xx"
+	case code >= 500:
+		return "5xx"
+	default:
+		return "other"
+	}
+}
+
+// WriteTo renders the current state of every metric in Prometheus text
+// exposition format.
+func (m *metricsRegistry) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	write := func(format string, args ...interface{}) {
+		c, _ := fmt.Fprintf(w, format, args...)
+		n += int64(c)
+	}
+
+	write("# HELP giproxy_requests_total Total proxied HTTP requests by response status class\n")
+	write("# TYPE giproxy_requests_total counter\n")
+	for _, kv := range sortedSnapshot(m.requestsByClass) {
+		write("giproxy_requests_total{class=%q} %d\n", kv.label, kv.count)
+	}
+
+	writeHistogramMetric(write, "giproxy_request_duration_seconds", "Proxied request duration in seconds", m.requestDuration)
+
+	write("# HELP giproxy_bytes_in_total Total request bytes received\n")
+	write("# TYPE giproxy_bytes_in_total counter\n")
+	write("giproxy_bytes_in_total %d\n", atomic.LoadUint64(&m.bytesIn))
+
+	write("# HELP giproxy_bytes_out_total Total response bytes written\n")
+	write("# TYPE giproxy_bytes_out_total counter\n")
+	write("giproxy_bytes_out_total %d\n", atomic.LoadUint64(&m.bytesOut))
+
+	write("# HELP giproxy_pool_size Current number of destination IPs in the pool\n")
+	write("# TYPE giproxy_pool_size gauge\n")
+	write("giproxy_pool_size %d\n", pool.Len())
+
+	write("# HELP giproxy_dial_by_prefix_total Dial attempts by source prefix and result\n")
+	write("# TYPE giproxy_dial_by_prefix_total counter\n")
+	for _, kv := range sortedSnapshot(m.dialByPrefix) {
+		prefix, result := splitLabel(kv.label)
+		write("giproxy_dial_by_prefix_total{prefix=%q,result=%q} %d\n", prefix, result, kv.count)
+	}
+
+	write("# HELP giproxy_dial_by_dest_total Dial attempts by destination IP and result\n")
+	write("# TYPE giproxy_dial_by_dest_total counter\n")
+	for _, kv := range sortedSnapshot(m.dialByDest) {
+		dest, result := splitLabel(kv.label)
+		write("giproxy_dial_by_dest_total{dest=%q,result=%q} %d\n", dest, result, kv.count)
+	}
+
+	writeHistogramMetric(write, "giproxy_dial_latency_seconds", "Dial connect latency in seconds", m.dialLatency)
+
+	write("# HELP giproxy_ipsource_refresh_total IP-list refresh attempts by source and result\n")
+	write("# TYPE giproxy_ipsource_refresh_total counter\n")
+	write("# HELP giproxy_ipsource_last_success_age_seconds Seconds since a source last refreshed successfully\n")
+	write("# TYPE giproxy_ipsource_last_success_age_seconds gauge\n")
+	for _, s := range sourceSnapshot() {
+		write("giproxy_ipsource_refresh_total{source=%q,result=%q} %d\n", s.Name, "success", s.SuccessCount)
+		write("giproxy_ipsource_refresh_total{source=%q,result=%q} %d\n", s.Name, "fail", s.FailCount)
+		if !s.LastSuccess.IsZero() {
+			write("giproxy_ipsource_last_success_age_seconds{source=%q} %.3f\n", s.Name, time.Since(s.LastSuccess).Seconds())
+		}
+	}
+
+	return n, nil
+}
+
+func writeHistogramMetric(write func(string, ...interface{}), name, help string, h *histogram) {
+	write("# HELP %s %s\n", name, help)
+	write("# TYPE %s histogram\n", name)
+	buckets, counts, sum, count := h.snapshot()
+	for i, b := range buckets {
+		write("%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(b, 'g', -1, 64), counts[i])
+	}
+	write("%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	write("%s_sum %g\n", name, sum)
+	write("%s_count %d\n", name, count)
+}
+
+func splitLabel(label string) (string, string) {
+	for i := len(label) - 1; i >= 0; i-- {
+		if label[i] == '|' {
+			return label[:i], label[i+1:]
+		}
+	}
+	return label, ""
+}
+
+type labelCount struct {
+	label string
+	count uint64
+}
+
+// sortedSnapshot returns a counterVec's entries sorted by label, so
+// exposition output is stable across scrapes.
+func sortedSnapshot(c *counterVec) []labelCount {
+	snap := c.snapshot()
+	out := make([]labelCount, 0, len(snap))
+	for label, count := range snap {
+		out = append(out, labelCount{label, count})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].label < out[j].label })
+	return out
+}
+
+// metricsHandler serves the current metrics in Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.WriteTo(w)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Health-tracking tunables for blacklisting flaky destination IPs.
+const (
+	poolMinSamples       = 5               // require at least this many attempts before blacklisting
+	poolFailureThreshold = 0.6             // skip addresses failing more than 60% of attempts
+	poolCooldown         = 2 * time.Minute // how long a blacklisted address is skipped
+	poolEWMAAlpha        = 0.2             // smoothing factor for latency EWMA
+)
+
+// ipStat tracks recent dial outcomes for a single destination address.
+type ipStat struct {
+	successes    uint64
+	failures     uint64
+	lastFail     time.Time
+	lastErr      string
+	ewmaLatency  time.Duration
+	hasLatency   bool
+}
+
+func (s *ipStat) blacklisted(now time.Time) bool {
+	total := s.successes + s.failures
+	if total < poolMinSamples {
+		return false
+	}
+	ratio := float64(s.failures) / float64(total)
+	if ratio <= poolFailureThreshold {
+		return false
+	}
+	return now.Sub(s.lastFail) < poolCooldown
+}
+
+// ipPool wraps the destination address set with per-address health state, so
+// that a stale or rate-limited upstream doesn't keep getting selected.
+type ipPool struct {
+	mu    sync.RWMutex
+	stats map[string]*ipStat
+	order []string // stable snapshot of current members, for /debug/pool
+}
+
+func newIPPool() *ipPool {
+	return &ipPool{stats: make(map[string]*ipStat)}
+}
+
+// Merge replaces the pool's membership with addrs, preserving health state
+// for addresses that are still present and dropping state for those that
+// have disappeared from the upstream list.
+func (p *ipPool) Merge(addrs []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fresh := make(map[string]*ipStat, len(addrs))
+	for _, ip := range addrs {
+		if existing, ok := p.stats[ip]; ok {
+			fresh[ip] = existing
+		} else {
+			fresh[ip] = &ipStat{}
+		}
+	}
+	p.stats = fresh
+
+	order := make([]string, len(addrs))
+	copy(order, addrs)
+	p.order = order
+}
+
+func (p *ipPool) Len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.order)
+}
+
+// Candidates draws up to n distinct, non-blacklisted addresses without
+// replacement, in randomized order, for use as dial candidates.
+func (p *ipPool) Candidates(n int) []string {
+	p.mu.RLock()
+	now := time.Now()
+	healthy := make([]string, 0, len(p.order))
+	for _, ip := range p.order {
+		if s := p.stats[ip]; s == nil || !s.blacklisted(now) {
+			healthy = append(healthy, ip)
+		}
+	}
+	p.mu.RUnlock()
+
+	if len(healthy) == 0 {
+		return nil
+	}
+	if n <= 0 || n > len(healthy) {
+		n = len(healthy)
+	}
+
+	picked := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		idx, err := rand.Int(rand.Reader, big.NewInt(int64(len(healthy))))
+		if err != nil {
+			picked = append(picked, healthy[0])
+			healthy = healthy[1:]
+			continue
+		}
+		j := idx.Int64()
+		picked = append(picked, healthy[j])
+		healthy[j] = healthy[len(healthy)-1]
+		healthy = healthy[:len(healthy)-1]
+	}
+	return picked
+}
+
+// MarkOK records a successful dial and its connect latency.
+func (p *ipPool) MarkOK(ip string, rtt time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.statLocked(ip)
+	s.successes++
+	if !s.hasLatency {
+		s.ewmaLatency = rtt
+		s.hasLatency = true
+	} else {
+		s.ewmaLatency = time.Duration(poolEWMAAlpha*float64(rtt) + (1-poolEWMAAlpha)*float64(s.ewmaLatency))
+	}
+}
+
+// MarkFail records a failed dial.
+func (p *ipPool) MarkFail(ip string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.statLocked(ip)
+	s.failures++
+	s.lastFail = time.Now()
+	if err != nil {
+		s.lastErr = err.Error()
+	}
+}
+
+// statLocked returns the stat entry for ip, creating it if the address is no
+// longer a pool member (e.g. a Merge dropped it while a dial was in flight).
+func (p *ipPool) statLocked(ip string) *ipStat {
+	s, ok := p.stats[ip]
+	if !ok {
+		s = &ipStat{}
+		p.stats[ip] = s
+	}
+	return s
+}
+
+// PoolEntry is a point-in-time view of one address's health, for reporting.
+type PoolEntry struct {
+	IP          string  `json:"ip"`
+	Successes   uint64  `json:"successes"`
+	Failures    uint64  `json:"failures"`
+	FailRatio   float64 `json:"fail_ratio"`
+	Blacklisted bool    `json:"blacklisted"`
+	LastFail    string  `json:"last_fail,omitempty"`
+	LastErr     string  `json:"last_error,omitempty"`
+	LatencyMS   float64 `json:"latency_ms,omitempty"`
+}
+
+// Snapshot returns a stable, sorted view of every tracked address.
+func (p *ipPool) Snapshot() []PoolEntry {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	now := time.Now()
+	entries := make([]PoolEntry, 0, len(p.order))
+	for _, ip := range p.order {
+		s := p.stats[ip]
+		if s == nil {
+			entries = append(entries, PoolEntry{IP: ip})
+			continue
+		}
+		total := s.successes + s.failures
+		var ratio float64
+		if total > 0 {
+			ratio = float64(s.failures) / float64(total)
+		}
+		e := PoolEntry{
+			IP:          ip,
+			Successes:   s.successes,
+			Failures:    s.failures,
+			FailRatio:   ratio,
+			Blacklisted: s.blacklisted(now),
+		}
+		if !s.lastFail.IsZero() {
+			e.LastFail = s.lastFail.Format(time.RFC3339)
+		}
+		e.LastErr = s.lastErr
+		if s.hasLatency {
+			e.LatencyMS = float64(s.ewmaLatency) / float64(time.Millisecond)
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].IP < entries[j].IP })
+	return entries
+}
+
+// debugPoolHandler dumps current per-destination health stats so operators
+// can see which upstream IPs are being drained.
+func debugPoolHandler(p *ipPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries := p.Snapshot()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "# pool size: %d\n", p.Len())
+		fmt.Fprintln(w, "# sources:")
+		for _, line := range sourceStatusLines() {
+			fmt.Fprintln(w, line)
+		}
+		fmt.Fprintln(w, "# addresses:")
+		for _, e := range entries {
+			status := "ok"
+			if e.Blacklisted {
+				status = "blacklisted"
+			}
+			fmt.Fprintf(w, "%-40s %-12s success=%-6d fail=%-6d fail_ratio=%.2f latency=%.1fms",
+				e.IP, status, e.Successes, e.Failures, e.FailRatio, e.LatencyMS)
+			if e.LastFail != "" {
+				fmt.Fprintf(w, " last_fail=%s err=%q", e.LastFail, e.LastErr)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
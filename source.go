@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ipSource produces candidate destination IPv6 addresses. Multiple sources
+// are composable: fetchAndReloadIPs unions their results before merging them
+// into the pool.
+type ipSource interface {
+	Name() string
+	Fetch(ctx context.Context) ([]string, error)
+}
+
+// sourceStatus records the outcome of a source's recent refresh attempts,
+// for the /debug/pool view and the /metrics exporter.
+type sourceStatus struct {
+	successCount uint64
+	failCount    uint64
+	lastSuccess  time.Time
+	lastErr      error
+}
+
+var sourceStatuses = struct {
+	mu sync.RWMutex
+	m  map[string]*sourceStatus
+}{m: make(map[string]*sourceStatus)}
+
+func recordSourceResult(name string, err error) {
+	sourceStatuses.mu.Lock()
+	defer sourceStatuses.mu.Unlock()
+	s, ok := sourceStatuses.m[name]
+	if !ok {
+		s = &sourceStatus{}
+		sourceStatuses.m[name] = s
+	}
+	if err == nil {
+		s.successCount++
+		s.lastSuccess = time.Now()
+		s.lastErr = nil
+	} else {
+		s.failCount++
+		s.lastErr = err
+	}
+}
+
+// sourceSnapshotEntry is a point-in-time view of one source's health.
+type sourceSnapshotEntry struct {
+	Name         string
+	SuccessCount uint64
+	FailCount    uint64
+	LastSuccess  time.Time
+	LastErr      error
+}
+
+// sourceSnapshot returns a stable, sorted view of every tracked source.
+func sourceSnapshot() []sourceSnapshotEntry {
+	sourceStatuses.mu.RLock()
+	defer sourceStatuses.mu.RUnlock()
+
+	entries := make([]sourceSnapshotEntry, 0, len(sourceStatuses.m))
+	for name, s := range sourceStatuses.m {
+		entries = append(entries, sourceSnapshotEntry{
+			Name:         name,
+			SuccessCount: s.successCount,
+			FailCount:    s.failCount,
+			LastSuccess:  s.lastSuccess,
+			LastErr:      s.lastErr,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// sourceStatusLines renders a human-readable summary of every source's
+// health, for debugPoolHandler.
+func sourceStatusLines() []string {
+	snapshot := sourceSnapshot()
+	lines := make([]string, 0, len(snapshot))
+	for _, s := range snapshot {
+		line := fmt.Sprintf("%-30s success=%-4d fail=%-4d", s.Name, s.SuccessCount, s.FailCount)
+		if s.LastSuccess.IsZero() {
+			line += " never succeeded"
+		} else {
+			line += fmt.Sprintf(" last_success_age=%s", time.Since(s.LastSuccess).Round(time.Second))
+		}
+		if s.LastErr != nil {
+			line += fmt.Sprintf(" last_error=%q", s.LastErr.Error())
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// httpListSource is the original mechanism: a newline-delimited list of
+// IPv6 addresses served over plain HTTP(S).
+type httpListSource struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPListSource(url string) *httpListSource {
+	return &httpListSource{url: url, client: &http.Client{Timeout: 15 * time.Second}}
+}
+
+func (s *httpListSource) Name() string { return "http:" + s.url }
+
+func (s *httpListSource) Fetch(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http status: %d", resp.StatusCode)
+	}
+
+	var ips []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if ip := net.ParseIP(line); ip != nil && ip.To4() == nil {
+			ips = append(ips, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read error: %v", err)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("empty valid IP list")
+	}
+	return ips, nil
+}
+
+// dnsCacheEntry holds a TTL-bounded AAAA answer for one hostname.
+type dnsCacheEntry struct {
+	ips     []string
+	expires time.Time
+}
+
+// dnsSource periodically resolves a set of hostnames (the target host plus
+// any configured aliases) via one or more user-supplied DNS servers,
+// filtering to AAAA records and caching each host's answer for the configured
+// ttl (the TTLs carried in the DNS records are not used).
+type dnsSource struct {
+	hosts   []string
+	servers []string // "https://..." for DoH, otherwise "host:port" classic DNS
+	ttl     time.Duration
+
+	mu    sync.Mutex
+	cache map[string]dnsCacheEntry
+}
+
+func newDNSSource(hosts, servers []string, ttl time.Duration) *dnsSource {
+	return &dnsSource{hosts: hosts, servers: servers, ttl: ttl, cache: make(map[string]dnsCacheEntry)}
+}
+
+func (s *dnsSource) Name() string { return "dns" }
+
+func (s *dnsSource) Fetch(ctx context.Context) ([]string, error) {
+	seen := make(map[string]struct{})
+	var merged []string
+	var firstErr error
+
+	for _, host := range s.hosts {
+		ips, err := s.resolveHost(ctx, host)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %v", host, err)
+			}
+			continue
+		}
+		for _, ip := range ips {
+			if _, ok := seen[ip]; !ok {
+				seen[ip] = struct{}{}
+				merged = append(merged, ip)
+			}
+		}
+	}
+
+	if len(merged) == 0 && firstErr != nil {
+		return nil, firstErr
+	}
+	return merged, nil
+}
+
+func (s *dnsSource) resolveHost(ctx context.Context, host string) ([]string, error) {
+	s.mu.Lock()
+	if entry, ok := s.cache[host]; ok && time.Now().Before(entry.expires) {
+		ips := entry.ips
+		s.mu.Unlock()
+		return ips, nil
+	}
+	s.mu.Unlock()
+
+	var lastErr error
+	for _, server := range s.servers {
+		ips, err := queryAAAA(ctx, server, host)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(ips) == 0 {
+			continue
+		}
+		s.mu.Lock()
+		s.cache[host] = dnsCacheEntry{ips: ips, expires: time.Now().Add(s.ttl)}
+		s.mu.Unlock()
+		return ips, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no AAAA records found")
+	}
+	return nil, lastErr
+}
+
+// queryAAAA resolves host's AAAA records against a single DNS server, which
+// may be a DoH endpoint (https://...), a DoT resolver (host:853, dialed over
+// TLS), or a plain classic DNS server (host:port, dialed over UDP). The wire
+// format is hand-rolled rather than pulled in from a third-party package,
+// keeping this module dependency-free.
+func queryAAAA(ctx context.Context, server, host string) ([]string, error) {
+	packed, id, err := buildAAAAQuery(host)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw []byte
+	if strings.HasPrefix(server, "https://") {
+		raw, err = queryDoH(ctx, server, packed)
+	} else {
+		raw, err = queryClassicDNS(ctx, server, packed)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return parseAAAAAnswers(raw, id, host)
+}
+
+// buildAAAAQuery encodes a minimal, single-question DNS query (RFC 1035
+// section 4) asking for the AAAA records of host, returning the wire bytes
+// alongside the random transaction ID so the caller can verify the response
+// matches.
+func buildAAAAQuery(host string) ([]byte, uint16, error) {
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	var buf bytes.Buffer
+	buf.Write(idBytes[:])         // ID
+	buf.Write([]byte{0x01, 0x00}) // flags: recursion desired
+	buf.Write([]byte{0x00, 0x01}) // QDCOUNT
+	buf.Write([]byte{0x00, 0x00}) // ANCOUNT
+	buf.Write([]byte{0x00, 0x00}) // NSCOUNT
+	buf.Write([]byte{0x00, 0x00}) // ARCOUNT
+
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) > 63 {
+			return nil, 0, fmt.Errorf("dns label too long: %q", label)
+		}
+		buf.WriteByte(byte(len(label)))
+		buf.WriteString(label)
+	}
+	buf.WriteByte(0) // root label
+
+	buf.Write([]byte{0x00, 0x1c}) // QTYPE AAAA (28)
+	buf.Write([]byte{0x00, 0x01}) // QCLASS IN
+
+	return buf.Bytes(), id, nil
+}
+
+// parseAAAAAnswers walks a raw DNS response and extracts every AAAA record
+// from the answer section, following name compression pointers as needed.
+// wantID and wantHost must match the transaction ID and question name of the
+// query this response is claimed to answer, guarding against a spoofed or
+// stray UDP datagram being accepted as a real answer.
+func parseAAAAAnswers(msg []byte, wantID uint16, wantHost string) ([]string, error) {
+	if len(msg) < 12 {
+		return nil, fmt.Errorf("dns response too short")
+	}
+	if gotID := binary.BigEndian.Uint16(msg[0:2]); gotID != wantID {
+		return nil, fmt.Errorf("dns response: transaction id mismatch (got %d, want %d)", gotID, wantID)
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:6]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:8]))
+
+	wantHost = strings.ToLower(strings.TrimSuffix(wantHost, "."))
+	offset := 12
+	var err error
+	for i := 0; i < qdcount; i++ {
+		var name string
+		if name, offset, err = parseDNSName(msg, offset); err != nil {
+			return nil, err
+		}
+		if i == 0 && strings.ToLower(strings.TrimSuffix(name, ".")) != wantHost {
+			return nil, fmt.Errorf("dns response: question name mismatch (got %q, want %q)", name, wantHost)
+		}
+		offset += 4 // QTYPE + QCLASS
+	}
+
+	var ips []string
+	for i := 0; i < ancount; i++ {
+		if _, offset, err = parseDNSName(msg, offset); err != nil {
+			return nil, err
+		}
+		if offset+10 > len(msg) {
+			return nil, fmt.Errorf("dns response: truncated answer record")
+		}
+		rtype := binary.BigEndian.Uint16(msg[offset : offset+2])
+		rdlen := int(binary.BigEndian.Uint16(msg[offset+8 : offset+10]))
+		offset += 10
+		if offset+rdlen > len(msg) {
+			return nil, fmt.Errorf("dns response: truncated rdata")
+		}
+		if rtype == 28 && rdlen == 16 { // AAAA
+			ip := make(net.IP, 16)
+			copy(ip, msg[offset:offset+rdlen])
+			ips = append(ips, ip.String())
+		}
+		offset += rdlen
+	}
+	return ips, nil
+}
+
+// parseDNSName decodes a (possibly compressed) DNS name starting at offset,
+// returning the name and the offset immediately following its encoding in
+// the original message.
+func parseDNSName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	pos := offset
+	next := -1
+
+	for hops := 0; hops < 128; hops++ {
+		if pos >= len(msg) {
+			return "", 0, fmt.Errorf("dns name: out of bounds")
+		}
+		length := int(msg[pos])
+
+		if length == 0 {
+			pos++
+			if next == -1 {
+				next = pos
+			}
+			return strings.Join(labels, "."), next, nil
+		}
+
+		if length&0xC0 == 0xC0 {
+			if pos+1 >= len(msg) {
+				return "", 0, fmt.Errorf("dns name: truncated pointer")
+			}
+			if next == -1 {
+				next = pos + 2
+			}
+			pos = int(length&0x3F)<<8 | int(msg[pos+1])
+			continue
+		}
+
+		pos++
+		if pos+length > len(msg) {
+			return "", 0, fmt.Errorf("dns name: label out of bounds")
+		}
+		labels = append(labels, string(msg[pos:pos+length]))
+		pos += length
+	}
+	return "", 0, fmt.Errorf("dns name: too many compression pointers")
+}
+
+// queryDoH performs a DNS-over-HTTPS request (RFC 8484, wire format) against
+// a DoH server URL such as "https://dns.google/dns-query".
+func queryDoH(ctx context.Context, server string, packed []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh status: %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+}
+
+// queryClassicDNS sends a wire-format query to a "host:port" DNS server
+// (port defaults to 53 if omitted), over UDP for plain DNS or over TLS
+// (RFC 7858) when the port is 853.
+func queryClassicDNS(ctx context.Context, server string, packed []byte) ([]byte, error) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		host, port = server, "53"
+	}
+	if port == "853" {
+		return queryDoT(ctx, net.JoinHostPort(host, port), packed)
+	}
+
+	d := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := d.DialContext(ctx, "udp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+	}
+
+	if _, err := conn.Write(packed); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// queryDoT performs a DNS-over-TLS query (RFC 7858) against a "host:853"
+// server, using the two-byte length prefix that classic DNS requires over
+// stream transports (RFC 1035 section 4.2.2).
+func queryDoT(ctx context.Context, server string, packed []byte) ([]byte, error) {
+	d := tls.Dialer{Config: &tls.Config{MinVersion: tls.VersionTLS12}}
+	conn, err := d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+	}
+
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(packed)))
+	if _, err := conn.Write(append(length[:], packed...)); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}